@@ -16,6 +16,10 @@ package locate
 
 import (
 	"bytes"
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/tidwall/btree"
@@ -26,6 +30,17 @@ import (
 // SortedRegionsV2 is a sorted btree.
 type SortedRegionsV2 struct {
 	b *btree.BTreeG[*btreeItem]
+
+	gcCloseOnce sync.Once
+	gcCloseCh   chan struct{}
+	gcEvicted   uint64
+
+	// pendingRefresh tracks regions that an in-flight loader is currently
+	// refreshing (marked via MarkPendingRefresh). Invalidate* calls skip these
+	// rather than delete them, so a loader that reinserts a fresher entry
+	// doesn't race with a concurrent invalidation and lose the update.
+	pendingMu      sync.Mutex
+	pendingRefresh map[RegionVerID]struct{}
 }
 
 // NewSortedRegions returns a new SortedRegions.
@@ -33,6 +48,7 @@ func NewSortedRegionsV2(_ int) *SortedRegionsV2 {
 	return &SortedRegionsV2{
 		b: btree.NewBTreeG(
 			func(a, b *btreeItem) bool { return a.Less(b) }),
+		pendingRefresh: make(map[RegionVerID]struct{}),
 	}
 }
 
@@ -43,9 +59,24 @@ func (s *SortedRegionsV2) ReplaceOrInsert(cachedRegion *Region) *Region {
 		return nil
 	}
 
+	carryOverStoreState(old.cachedRegion, cachedRegion)
 	return old.cachedRegion
 }
 
+// carryOverStoreState copies the TiFlash work-peer index (workTiFlashIdx)
+// from an evicted region's store into the store of the region that replaces
+// it. Without this, a region that is refreshed (e.g. after a heartbeat or
+// epoch bump) would reset its TiFlash work-peer index to zero and could keep
+// routing to a peer that is currently being transferred away. No other
+// per-store state is copied.
+func carryOverStoreState(old, fresh *Region) {
+	oldStore, freshStore := old.getStore(), fresh.getStore()
+	if oldStore == nil || freshStore == nil {
+		return
+	}
+	freshStore.workTiFlashIdx.Store(oldStore.workTiFlashIdx.Load())
+}
+
 // SearchByKey returns the region which contains the key. Note that the region might be expired and it's caller's duty to check the region TTL.
 func (s *SortedRegionsV2) SearchByKey(key []byte, isEndKey bool) (r *Region) {
 	s.b.Descend(newBtreeSearchItem(key), func(item *btreeItem) bool {
@@ -61,11 +92,24 @@ func (s *SortedRegionsV2) SearchByKey(key []byte, isEndKey bool) (r *Region) {
 	return
 }
 
-// AscendGreaterOrEqual returns all items that are greater than or equal to the key.
+// AscendGreaterOrEqual returns the regions cached in [startKey, endKey), at
+// most limit of them, in ascending order, along with holes: the sub-ranges
+// of [startKey, endKey) that the tree could not cover contiguously, either
+// because no region is cached there or because the cached region's TTL has
+// expired. Once limit regions have been collected the scan stops, and no
+// holes after the last returned region are reported. Reporting holes instead
+// of silently truncating at the first one lets the caller pass all of them
+// to FillHoles at once, rather than discovering them one miss at a time.
 // It is the caller's responsibility to make sure that startKey is a node in the B-tree, otherwise, the startKey will not be included in the return regions.
-func (s *SortedRegionsV2) AscendGreaterOrEqual(startKey, endKey []byte, limit int) (regions []*Region) {
+func (s *SortedRegionsV2) AscendGreaterOrEqual(startKey, endKey []byte, limit int) (regions []*Region, holes []Range, err error) {
 	now := time.Now().Unix()
 	lastStartKey := startKey
+	// needTrailingHoleCheck is cleared whenever iteration stops for a reason
+	// other than running off the end of [startKey, endKey): reaching limit,
+	// which leaves the rest of the range unexamined, or consuming a region
+	// whose EndKey is empty (the "infinity" sentinel, meaning it already
+	// covers everything up to endKey), which leaves no gap to report.
+	needTrailingHoleCheck := true
 
 	s.b.Ascend(newBtreeSearchItem(startKey), func(item *btreeItem) bool {
 		region := item.cachedRegion
@@ -73,14 +117,119 @@ func (s *SortedRegionsV2) AscendGreaterOrEqual(startKey, endKey []byte, limit in
 			return false
 		}
 		if !region.checkRegionCacheTTL(now) {
-			return false
+			holeEnd := region.EndKey()
+			if len(endKey) > 0 && (len(holeEnd) == 0 || bytes.Compare(holeEnd, endKey) > 0) {
+				holeEnd = endKey
+			}
+			holes = append(holes, Range{StartKey: lastStartKey, EndKey: holeEnd})
+			lastStartKey = region.EndKey()
+			if len(lastStartKey) == 0 {
+				needTrailingHoleCheck = false
+				return false
+			}
+			return true
 		}
 		if !region.Contains(lastStartKey) { // uncached hole
-			return false
+			holes = append(holes, Range{StartKey: lastStartKey, EndKey: region.StartKey()})
 		}
 		lastStartKey = region.EndKey()
 		regions = append(regions, region)
-		return len(regions) < limit
+		if len(lastStartKey) == 0 {
+			needTrailingHoleCheck = false
+			return false
+		}
+		if len(regions) >= limit {
+			needTrailingHoleCheck = false
+			return false
+		}
+		return true
+	})
+
+	if needTrailingHoleCheck && len(endKey) > 0 && bytes.Compare(lastStartKey, endKey) < 0 {
+		holes = append(holes, Range{StartKey: lastStartKey, EndKey: endKey})
+	}
+	return regions, holes, nil
+}
+
+// FillHoles fetches every hole reported by AscendGreaterOrEqual from PD via
+// loader, inserts the results into s, and returns regions merged with the
+// newly loaded ones in sorted order. It is meant to be called by the cache
+// layer above SortedRegionsV2 (the one that owns the PD client), so that
+// coprocessor task building and BR-style range planning can fill all known
+// holes in one call. loader is called once per region, sequentially, in key
+// order within each hole; the calls are not batched.
+func FillHoles(ctx context.Context, s *SortedRegionsV2, regions []*Region, holes []Range, loader func(ctx context.Context, key []byte) (*Region, error)) ([]*Region, error) {
+	for _, hole := range holes {
+		for key := hole.StartKey; len(hole.EndKey) == 0 || bytes.Compare(key, hole.EndKey) < 0; {
+			region, err := loader(ctx, key)
+			if err != nil {
+				return nil, err
+			}
+			s.ReplaceOrInsert(region)
+			regions = append(regions, region)
+			if key = region.EndKey(); len(key) == 0 {
+				break
+			}
+		}
+	}
+	sort.Slice(regions, func(i, j int) bool {
+		return bytes.Compare(regions[i].StartKey(), regions[j].StartKey()) < 0
+	})
+	return regions, nil
+}
+
+// Range represents a key range [StartKey, EndKey). Following the convention
+// used throughout the region cache, an empty StartKey means the beginning of
+// the keyspace and an empty EndKey means the end of the keyspace.
+type Range struct {
+	StartKey []byte
+	EndKey   []byte
+}
+
+// Intersect returns the sub-range of r clipped to [start, end), i.e.
+// [max(start, r.StartKey), min(end, r.EndKey)), and reports whether the two
+// ranges intersect at all.
+func (r Range) Intersect(start, end []byte) (_ Range, isIntersect bool) {
+	clippedStart := r.StartKey
+	if len(start) > 0 && (len(clippedStart) == 0 || bytes.Compare(start, clippedStart) > 0) {
+		clippedStart = start
+	}
+	clippedEnd := r.EndKey
+	if len(end) > 0 && (len(clippedEnd) == 0 || bytes.Compare(end, clippedEnd) < 0) {
+		clippedEnd = end
+	}
+	if len(clippedEnd) > 0 && bytes.Compare(clippedStart, clippedEnd) >= 0 {
+		return Range{}, false
+	}
+	return Range{StartKey: clippedStart, EndKey: clippedEnd}, true
+}
+
+// IntersectRange invokes fn for every cached region (regardless of TTL) whose
+// key range overlaps with [start, end), in ascending key order. It starts by
+// descending to the region that contains start, like SearchByKey, so a
+// region whose StartKey sorts before start is still included as long as it
+// covers start. Iteration stops as soon as fn returns false.
+func (s *SortedRegionsV2) IntersectRange(start, end []byte, fn func(*Region) bool) {
+	searchKey := start
+	if first := s.SearchByKey(start, false); first != nil {
+		searchKey = first.StartKey()
+	}
+	s.b.Ascend(newBtreeSearchItem(searchKey), func(item *btreeItem) bool {
+		region := item.cachedRegion
+		if len(end) > 0 && bytes.Compare(region.StartKey(), end) >= 0 {
+			return false
+		}
+		return fn(region)
+	})
+}
+
+// Overlaps returns every cached region (regardless of TTL) whose key range
+// overlaps with [start, end).
+func (s *SortedRegionsV2) Overlaps(start, end []byte) []*Region {
+	var regions []*Region
+	s.IntersectRange(start, end, func(r *Region) bool {
+		regions = append(regions, r)
+		return true
 	})
 	return regions
 }
@@ -114,6 +263,147 @@ func (s *SortedRegionsV2) removeIntersecting(r *Region, verID RegionVerID) ([]*b
 	return deleted, false
 }
 
+// MarkPendingRefresh marks verID as currently being refreshed by an
+// in-flight loader. While marked, InvalidateByVerID, InvalidateRange and
+// InvalidateByStore skip the region instead of deleting it, so the loader's
+// reinsert isn't raced by a concurrent invalidation. Call ClearPendingRefresh
+// once the refresh completes or is abandoned.
+func (s *SortedRegionsV2) MarkPendingRefresh(verID RegionVerID) {
+	s.pendingMu.Lock()
+	s.pendingRefresh[verID] = struct{}{}
+	s.pendingMu.Unlock()
+}
+
+// ClearPendingRefresh undoes a prior MarkPendingRefresh.
+func (s *SortedRegionsV2) ClearPendingRefresh(verID RegionVerID) {
+	s.pendingMu.Lock()
+	delete(s.pendingRefresh, verID)
+	s.pendingMu.Unlock()
+}
+
+// compareAndDelete deletes the region currently cached at key start, but
+// only if it is still the same region (by VerID) as verID and it isn't
+// marked pending-refresh. Everything - the pending check, the re-lookup by
+// key, and the delete - happens under the same lock that MarkPendingRefresh
+// takes, so the whole sequence is atomic with respect to a concurrent
+// loader's Mark/ReplaceOrInsert/Clear.
+//
+// This is a compare-and-delete, not a delete-by-captured-item: btree Delete
+// matches by key, not identity, so a caller that captured a *btreeItem
+// during an earlier scan and later called s.b.Delete(item) directly could
+// end up deleting whatever region currently sits at that key - including a
+// fresher region a loader reinserted there after the scan. Comparing verID
+// against the region actually found at start closes that gap the same way
+// removeIntersecting guards against removing a fresher region by comparing
+// epoch versions.
+func (s *SortedRegionsV2) compareAndDelete(verID RegionVerID, start []byte) bool {
+	s.pendingMu.Lock()
+	defer s.pendingMu.Unlock()
+
+	if _, ok := s.pendingRefresh[verID]; ok {
+		return false
+	}
+
+	var current *btreeItem
+	s.b.Ascend(newBtreeSearchItem(start), func(item *btreeItem) bool {
+		current = item
+		return false
+	})
+	if current == nil || current.cachedRegion.VerID() != verID {
+		return false
+	}
+	s.b.Delete(current)
+	return true
+}
+
+// InvalidateByVerID removes the cached region matching verID, e.g. after the
+// caller observes a "region not found" or epoch-not-match error for it. It
+// reports whether a matching region was found and removed.
+func (s *SortedRegionsV2) InvalidateByVerID(verID RegionVerID) bool {
+	var found *btreeItem
+	s.b.Scan(func(item *btreeItem) bool {
+		if item.cachedRegion.VerID() == verID {
+			found = item
+			return false
+		}
+		return true
+	})
+	if found == nil {
+		return false
+	}
+	return s.compareAndDelete(verID, found.cachedRegion.StartKey())
+}
+
+// InvalidateRange removes every cached region whose key range overlaps with
+// [start, end), without waiting for TTL, and returns how many were removed.
+func (s *SortedRegionsV2) InvalidateRange(start, end []byte) int {
+	searchKey := start
+	if first := s.SearchByKey(start, false); first != nil {
+		searchKey = first.StartKey()
+	}
+
+	type candidate struct {
+		verID RegionVerID
+		start []byte
+	}
+	var candidates []candidate
+	s.b.Ascend(newBtreeSearchItem(searchKey), func(item *btreeItem) bool {
+		if len(end) > 0 && bytes.Compare(item.cachedRegion.StartKey(), end) >= 0 {
+			return false
+		}
+		candidates = append(candidates, candidate{item.cachedRegion.VerID(), item.cachedRegion.StartKey()})
+		return true
+	})
+
+	count := 0
+	for _, c := range candidates {
+		if s.compareAndDelete(c.verID, c.start) {
+			count++
+		}
+	}
+	return count
+}
+
+// InvalidateByStore removes every cached region whose current leader or any
+// peer is served by storeID, e.g. after observing that store go down, and
+// returns how many were removed.
+func (s *SortedRegionsV2) InvalidateByStore(storeID uint64) int {
+	type candidate struct {
+		verID RegionVerID
+		start []byte
+	}
+	var candidates []candidate
+	s.b.Scan(func(item *btreeItem) bool {
+		if regionHasStore(item.cachedRegion, storeID) {
+			candidates = append(candidates, candidate{item.cachedRegion.VerID(), item.cachedRegion.StartKey()})
+		}
+		return true
+	})
+
+	count := 0
+	for _, c := range candidates {
+		if s.compareAndDelete(c.verID, c.start) {
+			count++
+		}
+	}
+	return count
+}
+
+// regionHasStore reports whether region's current leader or any peer is
+// served by storeID.
+func regionHasStore(region *Region, storeID uint64) bool {
+	store := region.getStore()
+	if store == nil {
+		return false
+	}
+	for _, st := range store.stores {
+		if st.StoreID() == storeID {
+			return true
+		}
+	}
+	return false
+}
+
 // Clear removes all items from the btree.
 func (s *SortedRegionsV2) Clear() {
 	s.b.Clear()
@@ -130,4 +420,78 @@ func (s *SortedRegionsV2) ValidRegionsInBtree(ts int64) (len int) {
 		return true
 	})
 	return
+}
+
+// RunGC starts a background goroutine that periodically scans the btree in
+// bounded batches and evicts regions whose cache TTL has expired, so that
+// the tree doesn't grow unboundedly with tombstoned entries under heavy
+// schema churn or frequent region splits. Each tick walks at most batchSize
+// items, resuming from where the previous tick left off, so a single tick
+// never holds the tree busy for long. The goroutine stops when stopCh is
+// closed or Close is called.
+func (s *SortedRegionsV2) RunGC(interval time.Duration, batchSize int, stopCh <-chan struct{}) {
+	s.gcCloseCh = make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		var cursor []byte
+		for {
+			select {
+			case <-ticker.C:
+				cursor = s.gcTick(cursor, batchSize)
+			case <-stopCh:
+				return
+			case <-s.gcCloseCh:
+				return
+			}
+		}
+	}()
+}
+
+// gcTick scans up to batchSize items starting at cursor, deletes the ones
+// whose TTL has expired, and returns the cursor the next tick should resume
+// from. It returns nil once the scan reaches the end of the tree, so the
+// next tick wraps around to the beginning.
+func (s *SortedRegionsV2) gcTick(cursor []byte, batchSize int) (nextCursor []byte) {
+	now := time.Now().Unix()
+	var expired []*btreeItem
+	scanned := 0
+
+	s.b.Ascend(newBtreeSearchItem(cursor), func(item *btreeItem) bool {
+		if scanned >= batchSize {
+			nextCursor = item.cachedRegion.StartKey()
+			return false
+		}
+		scanned++
+		if !item.cachedRegion.checkRegionCacheTTL(now) {
+			expired = append(expired, item)
+		}
+		return true
+	})
+
+	for _, item := range expired {
+		s.b.Delete(item)
+	}
+	if len(expired) > 0 {
+		atomic.AddUint64(&s.gcEvicted, uint64(len(expired)))
+	}
+	return nextCursor
+}
+
+// EvictedRegionCount returns the number of regions evicted by the
+// background GC goroutine started via RunGC, so operators can tune the
+// interval and batch size.
+func (s *SortedRegionsV2) EvictedRegionCount() uint64 {
+	return atomic.LoadUint64(&s.gcEvicted)
+}
+
+// Close stops the background GC goroutine started by RunGC. It is safe to
+// call even if RunGC was never started, and safe to call more than once.
+func (s *SortedRegionsV2) Close() {
+	s.gcCloseOnce.Do(func() {
+		if s.gcCloseCh != nil {
+			close(s.gcCloseCh)
+		}
+	})
 }
\ No newline at end of file
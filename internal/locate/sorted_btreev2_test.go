@@ -0,0 +1,233 @@
+// Copyright 2022 TiKV Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package locate
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pingcap/kvproto/pkg/metapb"
+	"github.com/stretchr/testify/require"
+)
+
+// freshenRegion stamps lastAccess so checkRegionCacheTTL treats the region
+// as not expired. createSampleRegion leaves lastAccess at its zero value,
+// which checkRegionCacheTTL treats as long expired.
+func freshenRegion(r *Region) {
+	atomic.StoreInt64(&r.lastAccess, time.Now().Unix())
+}
+
+func TestReplaceOrInsertCarriesOverWorkTiFlashIdx(t *testing.T) {
+	s := NewSortedRegionsV2(0)
+
+	region := createSampleRegion([]byte("a"), []byte("b"))
+	region.setStore(&regionStore{})
+	require.Nil(t, s.ReplaceOrInsert(region))
+	region.getStore().workTiFlashIdx.Store(3)
+
+	refreshed := createSampleRegion([]byte("a"), []byte("b"))
+	refreshed.setStore(&regionStore{})
+	old := s.ReplaceOrInsert(refreshed)
+	require.Same(t, region, old)
+	require.Equal(t, int32(3), refreshed.getStore().workTiFlashIdx.Load())
+}
+
+func TestRangeIntersect(t *testing.T) {
+	r := Range{StartKey: []byte("b"), EndKey: []byte("d")}
+
+	clipped, ok := r.Intersect([]byte("a"), []byte("c"))
+	require.True(t, ok)
+	require.Equal(t, Range{StartKey: []byte("b"), EndKey: []byte("c")}, clipped)
+
+	clipped, ok = r.Intersect([]byte("c"), nil)
+	require.True(t, ok)
+	require.Equal(t, Range{StartKey: []byte("c"), EndKey: []byte("d")}, clipped)
+
+	_, ok = r.Intersect([]byte("d"), []byte("e"))
+	require.False(t, ok)
+
+	clipped, ok = r.Intersect(nil, nil)
+	require.True(t, ok)
+	require.Equal(t, r, clipped)
+}
+
+func TestIntersectRangeAndOverlaps(t *testing.T) {
+	s := NewSortedRegionsV2(0)
+	s.ReplaceOrInsert(createSampleRegion([]byte("a"), []byte("c")))
+	s.ReplaceOrInsert(createSampleRegion([]byte("c"), []byte("e")))
+	s.ReplaceOrInsert(createSampleRegion([]byte("e"), []byte("g")))
+
+	regions := s.Overlaps([]byte("b"), []byte("f"))
+	require.Len(t, regions, 3)
+	require.Equal(t, []byte("a"), regions[0].StartKey())
+	require.Equal(t, []byte("c"), regions[1].StartKey())
+	require.Equal(t, []byte("e"), regions[2].StartKey())
+
+	var visited int
+	s.IntersectRange([]byte("c"), []byte("e"), func(*Region) bool {
+		visited++
+		return true
+	})
+	require.Equal(t, 1, visited)
+}
+
+func TestRunGCStopsOnClose(t *testing.T) {
+	s := NewSortedRegionsV2(0)
+	s.ReplaceOrInsert(createSampleRegion([]byte("a"), []byte("b")))
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	// Use an interval long enough that the ticker cannot plausibly fire
+	// before Close returns, so the assertion below isn't racing the GC tick.
+	s.RunGC(time.Hour, 16, stopCh)
+
+	// Close must not panic or block, whether or not RunGC has run a tick yet.
+	s.Close()
+	s.Close() // idempotent
+
+	require.Equal(t, uint64(0), s.EvictedRegionCount())
+}
+
+func TestInvalidateByVerID(t *testing.T) {
+	s := NewSortedRegionsV2(0)
+	region := createSampleRegion([]byte("a"), []byte("b"))
+	s.ReplaceOrInsert(region)
+
+	require.False(t, s.InvalidateByVerID(RegionVerID{id: region.VerID().id + 1}))
+
+	s.MarkPendingRefresh(region.VerID())
+	require.False(t, s.InvalidateByVerID(region.VerID()))
+	require.NotNil(t, s.SearchByKey([]byte("a"), false))
+
+	s.ClearPendingRefresh(region.VerID())
+	require.True(t, s.InvalidateByVerID(region.VerID()))
+	require.Nil(t, s.SearchByKey([]byte("a"), false))
+}
+
+func TestInvalidateRange(t *testing.T) {
+	s := NewSortedRegionsV2(0)
+	s.ReplaceOrInsert(createSampleRegion([]byte("a"), []byte("c")))
+	s.ReplaceOrInsert(createSampleRegion([]byte("c"), []byte("e")))
+	s.ReplaceOrInsert(createSampleRegion([]byte("e"), []byte("g")))
+
+	require.Equal(t, 2, s.InvalidateRange([]byte("b"), []byte("d")))
+	require.Nil(t, s.SearchByKey([]byte("a"), false))
+	require.Nil(t, s.SearchByKey([]byte("c"), false))
+	require.NotNil(t, s.SearchByKey([]byte("e"), false))
+}
+
+func TestAscendGreaterOrEqualReportsHoles(t *testing.T) {
+	s := NewSortedRegionsV2(0)
+	first := createSampleRegion([]byte("a"), []byte("c"))
+	freshenRegion(first)
+	second := createSampleRegion([]byte("e"), []byte("g"))
+	freshenRegion(second)
+	s.ReplaceOrInsert(first)
+	s.ReplaceOrInsert(second)
+
+	regions, holes, err := s.AscendGreaterOrEqual([]byte("a"), []byte("i"), 10)
+	require.NoError(t, err)
+	require.Len(t, regions, 2)
+	require.Equal(t, []Range{
+		{StartKey: []byte("c"), EndKey: []byte("e")},
+		{StartKey: []byte("g"), EndKey: []byte("i")},
+	}, holes)
+}
+
+func TestInvalidateDoesNotRemoveReinsertedRegion(t *testing.T) {
+	s := NewSortedRegionsV2(0)
+	region1 := createSampleRegion([]byte("a"), []byte("b"))
+	s.ReplaceOrInsert(region1)
+	verID1 := region1.VerID()
+
+	// Simulate a loader racing an invalidation that had already captured
+	// verID1/region1.StartKey() (e.g. from an earlier InvalidateByVerID scan
+	// or an InvalidateRange/InvalidateByStore candidate list): the loader
+	// marks verID1 pending, reinserts a fresher region at the same key, then
+	// clears the mark - all before the invalidation's compareAndDelete runs.
+	s.MarkPendingRefresh(verID1)
+	region2 := createSampleRegion([]byte("a"), []byte("b"))
+	region2.meta.RegionEpoch = &metapb.RegionEpoch{Version: verID1.GetVer() + 1}
+	s.ReplaceOrInsert(region2)
+	s.ClearPendingRefresh(verID1)
+
+	// compareAndDelete re-checks what's actually at the key under the same
+	// lock, so the stale verID1 must not match region2 and nothing is deleted.
+	require.False(t, s.compareAndDelete(verID1, region1.StartKey()))
+	require.Same(t, region2, s.SearchByKey([]byte("a"), false))
+
+	// A compareAndDelete for the region that's actually still cached works as before.
+	require.True(t, s.compareAndDelete(region2.VerID(), region2.StartKey()))
+	require.Nil(t, s.SearchByKey([]byte("a"), false))
+}
+
+func TestInvalidateByStore(t *testing.T) {
+	s := NewSortedRegionsV2(0)
+
+	region1 := createSampleRegion([]byte("a"), []byte("b"))
+	region1.setStore(&regionStore{stores: []*Store{{storeID: 1}}})
+	s.ReplaceOrInsert(region1)
+
+	region2 := createSampleRegion([]byte("c"), []byte("d"))
+	region2.setStore(&regionStore{stores: []*Store{{storeID: 2}}})
+	s.ReplaceOrInsert(region2)
+
+	require.Equal(t, 1, s.InvalidateByStore(1))
+	require.Nil(t, s.SearchByKey([]byte("a"), false))
+	require.NotNil(t, s.SearchByKey([]byte("c"), false))
+
+	s.MarkPendingRefresh(region2.VerID())
+	require.Equal(t, 0, s.InvalidateByStore(2))
+	require.NotNil(t, s.SearchByKey([]byte("c"), false))
+
+	s.ClearPendingRefresh(region2.VerID())
+	require.Equal(t, 1, s.InvalidateByStore(2))
+	require.Nil(t, s.SearchByKey([]byte("c"), false))
+}
+
+func TestAscendGreaterOrEqualOpenEndedRegionReportsNoTrailingHole(t *testing.T) {
+	s := NewSortedRegionsV2(0)
+	region := createSampleRegion([]byte("m"), nil) // EndKey empty: covers to the end of the keyspace
+	freshenRegion(region)
+	s.ReplaceOrInsert(region)
+
+	regions, holes, err := s.AscendGreaterOrEqual([]byte("m"), []byte("z"), 10)
+	require.NoError(t, err)
+	require.Len(t, regions, 1)
+	require.Empty(t, holes)
+}
+
+func TestFillHoles(t *testing.T) {
+	s := NewSortedRegionsV2(0)
+	first := createSampleRegion([]byte("a"), []byte("c"))
+	freshenRegion(first)
+	s.ReplaceOrInsert(first)
+
+	regions, holes, err := s.AscendGreaterOrEqual([]byte("a"), []byte("e"), 10)
+	require.NoError(t, err)
+	require.Len(t, holes, 1)
+
+	loaded := createSampleRegion([]byte("c"), []byte("e"))
+	freshenRegion(loaded)
+	regions, err = FillHoles(context.Background(), s, regions, holes, func(_ context.Context, key []byte) (*Region, error) {
+		require.Equal(t, []byte("c"), key)
+		return loaded, nil
+	})
+	require.NoError(t, err)
+	require.Len(t, regions, 2)
+	require.NotNil(t, s.SearchByKey([]byte("c"), false))
+}